@@ -0,0 +1,132 @@
+package main
+
+import (
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Default cache TTLs, overridable via SENDGRID_CACHE_TTL_DAY and
+// SENDGRID_CACHE_TTL_MONTH. Day-aggregated stats are still accumulating
+// throughout the day they cover, so they're kept fresh more aggressively
+// than month-to-date rollups, which change more slowly.
+const (
+	defaultDayCacheTTL   = 5 * time.Minute
+	defaultMonthCacheTTL = 15 * time.Minute
+)
+
+var (
+	dayCacheTTL   = newCacheTTL("SENDGRID_CACHE_TTL_DAY", defaultDayCacheTTL)
+	monthCacheTTL = newCacheTTL("SENDGRID_CACHE_TTL_MONTH", defaultMonthCacheTTL)
+)
+
+func newCacheTTL(env string, def time.Duration) time.Duration {
+	v := os.Getenv(env)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		log.Printf("invalid %s %q, falling back to %s: %v", env, v, def, err)
+		return def
+	}
+	return d
+}
+
+// cacheTTL returns how long a cached entry for the given aggregation window
+// stays valid.
+func cacheTTL(aggregatedby string) time.Duration {
+	if aggregatedby == "month" {
+		return monthCacheTTL
+	}
+	return dayCacheTTL
+}
+
+var (
+	cacheHitsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "cache_hits_total",
+		Help:      "Total number of stats scrapes served from the in-memory cache.",
+	})
+	cacheMissesTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "cache_misses_total",
+		Help:      "Total number of stats scrapes not found in the in-memory cache.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(cacheHitsTotal, cacheMissesTotal)
+}
+
+// statsCache is a small in-memory, per-entry-TTL cache of fetchResults keyed
+// by request shape (path, aggregated_by, filters, and date range). It sits
+// in front of the SendGrid API so scrapes that overlap within an entry's
+// TTL - whether from a short scrape_interval or the window widened by
+// SENDGRID_LOOKBACK_DAYS - don't re-fetch data that hasn't gone stale yet.
+type statsCache struct {
+	mu      sync.Mutex
+	entries map[string]cacheEntry
+}
+
+type cacheEntry struct {
+	result    *fetchResult
+	expiresAt time.Time
+}
+
+// cacheSweepInterval is how often newStatsCache's background goroutine
+// scans for expired entries. Without this, entries for dates the cache key
+// will never be looked up under again (e.g. yesterday, once the scrape
+// window has rolled past it) would sit in entries for the life of the
+// process instead of just until their TTL.
+const cacheSweepInterval = time.Minute
+
+func newStatsCache() *statsCache {
+	c := &statsCache{entries: make(map[string]cacheEntry)}
+	go c.sweepExpired()
+	return c
+}
+
+func (c *statsCache) sweepExpired() {
+	ticker := time.NewTicker(cacheSweepInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		c.mu.Lock()
+		now := time.Now()
+		for key, e := range c.entries {
+			if now.After(e.expiresAt) {
+				delete(c.entries, key)
+			}
+		}
+		c.mu.Unlock()
+	}
+}
+
+func (c *statsCache) get(key string) (*fetchResult, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[key]
+	if !ok || time.Now().After(e.expiresAt) {
+		if ok {
+			delete(c.entries, key)
+		}
+		cacheMissesTotal.Inc()
+		return nil, false
+	}
+	cacheHitsTotal.Inc()
+	return e.result, true
+}
+
+func (c *statsCache) set(key string, result *fetchResult, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries[key] = cacheEntry{
+		result:    result,
+		expiresAt: time.Now().Add(ttl),
+	}
+}
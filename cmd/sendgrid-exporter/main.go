@@ -3,19 +3,23 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
-	"io"
 	"log"
 	"net/http"
 	"net/url"
 	"os"
 	"os/signal"
+	"strconv"
 	"syscall"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/prometheus/common/version"
+	"golang.org/x/sync/errgroup"
+	"golang.org/x/sync/singleflight"
 )
 
 var (
@@ -26,23 +30,126 @@ var (
 	listenAddr      = os.Getenv("LISTEN_ADDR")
 	metricsEndpoint = os.Getenv("METRICS_ENDPOINT")
 	apiKey          = os.Getenv("SENDGRID_API_KEY")
+
+	// exporterConfigPath switches the exporter into multi-account mode: each
+	// account in the file gets its own SendGrid API key and an "account"
+	// label on every metric. Leaving it unset preserves the single-account,
+	// unlabeled behavior existing deployments already depend on.
+	exporterConfigPath = os.Getenv("SENDGRID_EXPORTER_CONFIG")
 )
 
+// labelAccountFlag opts a single-account, env-var-configured deployment into
+// the "account" labeled metric set without requiring a config file. It's
+// implied automatically whenever exporterConfigPath is set.
+var labelAccountFlag = flag.Bool("label.account", false, "Add an account label to every emitted metric (implied by SENDGRID_EXPORTER_CONFIG).")
+
+const defaultHTTPTimeout = 10 * time.Second
+
+// httpClient is shared by every request to SendGrid's API. It clones the
+// default transport so keep-alives stay enabled across scrapes instead of
+// dialing a fresh connection per call, and bounds both a per-response-header
+// wait and the overall request so a wedged upstream can't stall a scrape
+// indefinitely.
+var httpClient = newHTTPClient()
+
+// scrapeGroup collapses overlapping calls to collectStats for the same
+// path/aggregated_by value into a single in-flight SendGrid request, so multiple
+// Prometheus servers (or a short scrape_interval) don't multiply API calls
+// against SendGrid's rate limit.
+var scrapeGroup singleflight.Group
+
+// scrapeCache sits in front of scrapeGroup so repeat scrapes within an
+// entry's TTL (see cache.go) are served without hitting SendGrid at all,
+// not just deduplicated against an in-flight request.
+var scrapeCache = newStatsCache()
+
+// defaultLookbackDays is how many days before today start_date is widened
+// to when SENDGRID_LOOKBACK_DAYS isn't set. A lookback of 1 covers
+// yesterday and today, so that yesterday's stats (which may still have
+// been settling at the time of an earlier scrape) get re-reported once
+// more before rolling out of range.
+const defaultLookbackDays = 1
+
+// lookbackDays widens every scrape's start_date so days that were still
+// accumulating stats at the time of an earlier scrape get re-reported
+// until their numbers have settled.
+var lookbackDays = newLookbackDays()
+
+func newLookbackDays() int {
+	v := os.Getenv("SENDGRID_LOOKBACK_DAYS")
+	if v == "" {
+		return defaultLookbackDays
+	}
+	d, err := strconv.Atoi(v)
+	if err != nil || d < 0 {
+		log.Printf("invalid SENDGRID_LOOKBACK_DAYS %q, falling back to %d", v, defaultLookbackDays)
+		return defaultLookbackDays
+	}
+	return d
+}
+
+// dateRange returns the start_date/end_date SendGrid query parameters for a
+// scrape: start is lookbackDays days before today, end is today, so a
+// lookbackDays of 0 is the single-day "just today" window and each day
+// above that adds one more day of look-back.
+func dateRange() (start, end string) {
+	today := time.Now()
+	return today.AddDate(0, 0, -lookbackDays).Format("2006-01-02"), today.Format("2006-01-02")
+}
+
+func newHTTPClient() *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DisableKeepAlives = false
+	transport.ResponseHeaderTimeout = 5 * time.Second
+
+	timeout := defaultHTTPTimeout
+	if v := os.Getenv("SENDGRID_HTTP_TIMEOUT"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			log.Printf("invalid SENDGRID_HTTP_TIMEOUT %q, falling back to %s: %v", v, defaultHTTPTimeout, err)
+		} else {
+			timeout = d
+		}
+	}
+
+	return &http.Client{
+		Transport: transport,
+		Timeout:   timeout,
+	}
+}
+
 func init() {
 	prometheus.MustRegister(version.NewCollector("sendgrid_exporter"))
 }
 
 func main() {
+	flag.Parse()
+
 	fmt.Println("Starting sendgrid_exporter", version.Info())
 	fmt.Println("Build context", version.BuildContext())
-	if len(apiKey) == 0 {
-		log.Fatal("require env: SENDGRID_API_KEY")
-	}
 
 	fmt.Printf("LISTEN_ADDR: %s\n", listenAddr)
 	fmt.Printf("METRICS_ENDPOINT: %s\n", metricsEndpoint)
 
-	collector := newCollector()
+	var collector prometheus.Collector
+	switch {
+	case exporterConfigPath != "":
+		cfg, err := loadConfig(exporterConfigPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		collector = newMultiAccountCollector(cfg.Accounts)
+	case *labelAccountFlag:
+		if len(apiKey) == 0 {
+			log.Fatal("require env: SENDGRID_API_KEY")
+		}
+		collector = newMultiAccountCollector(singleAccountConfig().Accounts)
+	default:
+		if len(apiKey) == 0 {
+			log.Fatal("require env: SENDGRID_API_KEY")
+		}
+		collector = newCollector()
+	}
 	prometheus.MustRegister(collector)
 
 	sig := make(chan os.Signal, 1)
@@ -80,6 +187,23 @@ func main() {
 type Collector struct {
 	up prometheus.Gauge
 
+	scrapesTotal       prometheus.Counter
+	scrapeErrorsTotal  *prometheus.CounterVec
+	scrapeDuration     *prometheus.HistogramVec
+	rateLimitRemaining *prometheus.GaugeVec
+	rateLimitReset     *prometheus.GaugeVec
+
+	categoryMetrics        metricFamily
+	subuserMetrics         metricFamily
+	geoMetrics             metricFamily
+	browserMetrics         metricFamily
+	mailboxProviderMetrics metricFamily
+
+	// The daily* and monthly* descriptors keep their original, unlabeled FQ
+	// names (dailyblocks, monthlydelivered, ...) rather than going through
+	// metricFamily, so existing single-account dashboards built against them
+	// don't break. Multi-account mode (MultiAccountCollector) is the
+	// opt-in path for the richer, "date"-labeled metric set.
 	dailyblocks             *prometheus.Desc
 	dailybounceDrops        *prometheus.Desc
 	dailybounces            *prometheus.Desc
@@ -121,6 +245,36 @@ func newCollector() *Collector {
 			Name:      "up",
 			Help:      "up",
 		}),
+		scrapesTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "scrapes_total",
+			Help:      "Total number of scrapes of the SendGrid API.",
+		}),
+		scrapeErrorsTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "scrape_errors_total",
+			Help:      "Total number of failed scrapes of the SendGrid API, by reason.",
+		}, []string{"aggregated_by", "reason"}),
+		scrapeDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "scrape_duration_seconds",
+			Help:      "Duration of SendGrid API scrapes.",
+		}, []string{"path", "aggregated_by"}),
+		rateLimitRemaining: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "api_rate_limit_remaining",
+			Help:      "Remaining SendGrid API requests allowed in the current rate-limit window, from the X-RateLimit-Remaining response header.",
+		}, []string{"path", "aggregated_by"}),
+		rateLimitReset: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "api_rate_limit_reset_seconds",
+			Help:      "Seconds until the SendGrid API rate-limit window resets, from the X-RateLimit-Reset response header.",
+		}, []string{"path", "aggregated_by"}),
+		categoryMetrics:        newMetricFamily("category", []string{"category", "aggregated_by", "date"}),
+		subuserMetrics:         newMetricFamily("subuser", []string{"subuser", "aggregated_by", "date"}),
+		geoMetrics:             newMetricFamily("geo", []string{"country", "aggregated_by", "date"}),
+		browserMetrics:         newMetricFamily("browser", []string{"browser", "aggregated_by", "date"}),
+		mailboxProviderMetrics: newMetricFamily("mailbox_provider", []string{"mailbox_provider", "aggregated_by", "date"}),
 		dailyblocks: prometheus.NewDesc(
 			prometheus.BuildFQName(namespace, "", "dailyblocks"),
 			"dailyblocks",
@@ -318,6 +472,16 @@ func newCollector() *Collector {
 
 func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
 	c.up.Describe(ch)
+	c.scrapesTotal.Describe(ch)
+	c.scrapeErrorsTotal.Describe(ch)
+	c.scrapeDuration.Describe(ch)
+	c.rateLimitRemaining.Describe(ch)
+	c.rateLimitReset.Describe(ch)
+	c.categoryMetrics.Describe(ch)
+	c.subuserMetrics.Describe(ch)
+	c.geoMetrics.Describe(ch)
+	c.browserMetrics.Describe(ch)
+	c.mailboxProviderMetrics.Describe(ch)
 	ch <- c.dailyblocks
 	ch <- c.dailybounceDrops
 	ch <- c.dailybounces
@@ -353,8 +517,30 @@ func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
 }
 
 func (c *Collector) Collect(ch chan<- prometheus.Metric) {
-	metrics, err := collectMetrics("day")
-	totalmetrics, err1 := collectMetrics("month")
+	var dayResult, monthResult *fetchResult
+
+	c.scrapesTotal.Inc()
+
+	g, _ := errgroup.WithContext(context.Background())
+	g.Go(func() error {
+		var err error
+		dayResult, err = c.scrape("day")
+		return err
+	})
+	g.Go(func() error {
+		var err error
+		monthResult, err = c.scrape("month")
+		return err
+	})
+
+	err := g.Wait()
+
+	ch <- c.scrapesTotal
+	c.scrapeErrorsTotal.Collect(ch)
+	c.scrapeDuration.Collect(ch)
+	c.rateLimitRemaining.Collect(ch)
+	c.rateLimitReset.Collect(ch)
+
 	if err != nil {
 		log.Println(err)
 		c.up.Set(0)
@@ -362,250 +548,97 @@ func (c *Collector) Collect(ch chan<- prometheus.Metric) {
 		return
 	}
 
-	if err1 != nil {
-		log.Println(err1)
-		c.up.Set(0)
-		ch <- c.up
-		return
-	}
+	c.up.Set(1)
+	ch <- c.up
 
-	if len(metrics) == 0 {
-		log.Println(err)
-		c.up.Set(0)
-		ch <- c.up
-		return
+	// The daily*/monthly* descriptors have no "date" label (see the
+	// Collector struct doc comment), so a widened SENDGRID_LOOKBACK_DAYS
+	// window would otherwise try to report several dates under the same
+	// unlabeled series. Report only the most recent date here, same as
+	// before lookback existed; switch to MultiAccountCollector for the
+	// full, "date"-labeled history.
+	if n := len(monthResult.stats); n > 0 {
+		latest := monthResult.stats[n-1]
+		for _, s1 := range latest.Stats {
+			ch <- prometheus.MustNewConstMetric(c.monthlyblocks, prometheus.GaugeValue, float64(s1.Metrics.Blocks), s1.Type, s1.Name)
+			ch <- prometheus.MustNewConstMetric(c.monthlybounceDrops, prometheus.GaugeValue, float64(s1.Metrics.BounceDrops), s1.Type, s1.Name)
+			ch <- prometheus.MustNewConstMetric(c.monthlybounces, prometheus.GaugeValue, float64(s1.Metrics.Bounces), s1.Type, s1.Name)
+			ch <- prometheus.MustNewConstMetric(c.monthlyclicks, prometheus.GaugeValue, float64(s1.Metrics.Clicks), s1.Type, s1.Name)
+			ch <- prometheus.MustNewConstMetric(c.monthlydeferred, prometheus.GaugeValue, float64(s1.Metrics.Deferred), s1.Type, s1.Name)
+			ch <- prometheus.MustNewConstMetric(c.monthlydelivered, prometheus.GaugeValue, float64(s1.Metrics.Delivered), s1.Type, s1.Name)
+			ch <- prometheus.MustNewConstMetric(c.monthlyinvalidEmails, prometheus.GaugeValue, float64(s1.Metrics.InvalidEmails), s1.Type, s1.Name)
+			ch <- prometheus.MustNewConstMetric(c.monthlyopens, prometheus.GaugeValue, float64(s1.Metrics.Opens), s1.Type, s1.Name)
+			ch <- prometheus.MustNewConstMetric(c.monthlyprocessed, prometheus.GaugeValue, float64(s1.Metrics.Processed), s1.Type, s1.Name)
+			ch <- prometheus.MustNewConstMetric(c.monthlyrequests, prometheus.GaugeValue, float64(s1.Metrics.Requests), s1.Type, s1.Name)
+			ch <- prometheus.MustNewConstMetric(c.monthlyspamReportDrops, prometheus.GaugeValue, float64(s1.Metrics.SpamReportDrops), s1.Type, s1.Name)
+			ch <- prometheus.MustNewConstMetric(c.monthlyspamReports, prometheus.GaugeValue, float64(s1.Metrics.SpamReports), s1.Type, s1.Name)
+			ch <- prometheus.MustNewConstMetric(c.monthlyuniqueClicks, prometheus.GaugeValue, float64(s1.Metrics.UniqueClicks), s1.Type, s1.Name)
+			ch <- prometheus.MustNewConstMetric(c.monthlyuniqueOpens, prometheus.GaugeValue, float64(s1.Metrics.UniqueOpens), s1.Type, s1.Name)
+			ch <- prometheus.MustNewConstMetric(c.monthlyunsubscribeDrops, prometheus.GaugeValue, float64(s1.Metrics.UnsubscribeDrops), s1.Type, s1.Name)
+			ch <- prometheus.MustNewConstMetric(c.monthlyunsubscribes, prometheus.GaugeValue, float64(s1.Metrics.Unsubscribes), s1.Type, s1.Name)
+		}
+	}
+	if n := len(dayResult.stats); n > 0 {
+		latest := dayResult.stats[n-1]
+		for _, s := range latest.Stats {
+			ch <- prometheus.MustNewConstMetric(c.dailyblocks, prometheus.GaugeValue, float64(s.Metrics.Blocks), s.Type, s.Name)
+			ch <- prometheus.MustNewConstMetric(c.dailybounceDrops, prometheus.GaugeValue, float64(s.Metrics.BounceDrops), s.Type, s.Name)
+			ch <- prometheus.MustNewConstMetric(c.dailybounces, prometheus.GaugeValue, float64(s.Metrics.Bounces), s.Type, s.Name)
+			ch <- prometheus.MustNewConstMetric(c.dailyclicks, prometheus.GaugeValue, float64(s.Metrics.Clicks), s.Type, s.Name)
+			ch <- prometheus.MustNewConstMetric(c.dailydeferred, prometheus.GaugeValue, float64(s.Metrics.Deferred), s.Type, s.Name)
+			ch <- prometheus.MustNewConstMetric(c.dailydelivered, prometheus.GaugeValue, float64(s.Metrics.Delivered), s.Type, s.Name)
+			ch <- prometheus.MustNewConstMetric(c.dailyinvalidEmails, prometheus.GaugeValue, float64(s.Metrics.InvalidEmails), s.Type, s.Name)
+			ch <- prometheus.MustNewConstMetric(c.dailyopens, prometheus.GaugeValue, float64(s.Metrics.Opens), s.Type, s.Name)
+			ch <- prometheus.MustNewConstMetric(c.dailyprocessed, prometheus.GaugeValue, float64(s.Metrics.Processed), s.Type, s.Name)
+			ch <- prometheus.MustNewConstMetric(c.dailyrequests, prometheus.GaugeValue, float64(s.Metrics.Requests), s.Type, s.Name)
+			ch <- prometheus.MustNewConstMetric(c.dailyspamReportDrops, prometheus.GaugeValue, float64(s.Metrics.SpamReportDrops), s.Type, s.Name)
+			ch <- prometheus.MustNewConstMetric(c.dailyspamReports, prometheus.GaugeValue, float64(s.Metrics.SpamReports), s.Type, s.Name)
+			ch <- prometheus.MustNewConstMetric(c.dailyuniqueClicks, prometheus.GaugeValue, float64(s.Metrics.UniqueClicks), s.Type, s.Name)
+			ch <- prometheus.MustNewConstMetric(c.dailyuniqueOpens, prometheus.GaugeValue, float64(s.Metrics.UniqueOpens), s.Type, s.Name)
+			ch <- prometheus.MustNewConstMetric(c.dailyunsubscribeDrops, prometheus.GaugeValue, float64(s.Metrics.UnsubscribeDrops), s.Type, s.Name)
+			ch <- prometheus.MustNewConstMetric(c.dailyunsubscribes, prometheus.GaugeValue, float64(s.Metrics.Unsubscribes), s.Type, s.Name)
+		}
 	}
 
-	c.up.Set(1)
-	ch <- c.up
+	c.collectSegments(ch)
+}
 
-	for _, s1 := range totalmetrics[0].Stats {
-		ch <- prometheus.MustNewConstMetric(
-			c.monthlyblocks,
-			prometheus.GaugeValue,
-			float64(s1.Metrics.Blocks),
-			s1.Type,
-			s1.Name,
-		)
-		ch <- prometheus.MustNewConstMetric(
-			c.monthlybounceDrops,
-			prometheus.GaugeValue,
-			float64(s1.Metrics.BounceDrops),
-			s1.Type,
-			s1.Name,
-		)
-		ch <- prometheus.MustNewConstMetric(
-			c.monthlybounces,
-			prometheus.GaugeValue,
-			float64(s1.Metrics.Bounces),
-			s1.Type,
-			s1.Name,
-		)
-		ch <- prometheus.MustNewConstMetric(
-			c.monthlyclicks,
-			prometheus.GaugeValue,
-			float64(s1.Metrics.Clicks),
-			s1.Type,
-			s1.Name,
-		)
-		ch <- prometheus.MustNewConstMetric(
-			c.monthlydeferred,
-			prometheus.GaugeValue,
-			float64(s1.Metrics.Deferred),
-			s1.Type,
-			s1.Name,
-		)
-		ch <- prometheus.MustNewConstMetric(
-			c.monthlydelivered,
-			prometheus.GaugeValue,
-			float64(s1.Metrics.Delivered),
-			s1.Type,
-			s1.Name,
-		)
-		ch <- prometheus.MustNewConstMetric(
-			c.monthlyinvalidEmails,
-			prometheus.GaugeValue,
-			float64(s1.Metrics.InvalidEmails),
-			s1.Type,
-			s1.Name,
-		)
-		ch <- prometheus.MustNewConstMetric(
-			c.monthlyopens,
-			prometheus.GaugeValue,
-			float64(s1.Metrics.Opens),
-			s1.Type,
-			s1.Name,
-		)
-		ch <- prometheus.MustNewConstMetric(
-			c.monthlyprocessed,
-			prometheus.GaugeValue,
-			float64(s1.Metrics.Processed),
-			s1.Type,
-			s1.Name,
-		)
-		ch <- prometheus.MustNewConstMetric(
-			c.monthlyrequests,
-			prometheus.GaugeValue,
-			float64(s1.Metrics.Requests),
-			s1.Type,
-			s1.Name,
-		)
-		ch <- prometheus.MustNewConstMetric(
-			c.monthlyspamReportDrops,
-			prometheus.GaugeValue,
-			float64(s1.Metrics.SpamReportDrops),
-			s1.Type,
-			s1.Name,
-		)
-		ch <- prometheus.MustNewConstMetric(
-			c.monthlyspamReports,
-			prometheus.GaugeValue,
-			float64(s1.Metrics.SpamReports),
-			s1.Type,
-			s1.Name,
-		)
-		ch <- prometheus.MustNewConstMetric(
-			c.monthlyuniqueClicks,
-			prometheus.GaugeValue,
-			float64(s1.Metrics.UniqueClicks),
-			s1.Type,
-			s1.Name,
-		)
-		ch <- prometheus.MustNewConstMetric(
-			c.monthlyuniqueOpens,
-			prometheus.GaugeValue,
-			float64(s1.Metrics.UniqueOpens),
-			s1.Type,
-			s1.Name,
-		)
-		ch <- prometheus.MustNewConstMetric(
-			c.monthlyunsubscribeDrops,
-			prometheus.GaugeValue,
-			float64(s1.Metrics.UnsubscribeDrops),
-			s1.Type,
-			s1.Name,
-		)
-		ch <- prometheus.MustNewConstMetric(
-			c.monthlyunsubscribes,
-			prometheus.GaugeValue,
-			float64(s1.Metrics.Unsubscribes),
-			s1.Type,
-			s1.Name,
-		)
+// collectSegments fetches and emits the optional, dimension-segmented stats
+// endpoints (categories, subusers, geo, browsers, mailbox providers) that
+// have been enabled via env vars. Unlike the account-wide stats above, a
+// failure here only logs and skips that segment rather than marking the
+// whole scrape down, since these are opt-in extras.
+func (c *Collector) collectSegments(ch chan<- prometheus.Metric) {
+	if enableCategories && len(categoriesSegment.values) > 0 {
+		c.collectSegment(ch, categoriesSegment, c.categoryMetrics)
+	}
+	if enableSubusers && len(subusersSegment.values) > 0 {
+		c.collectSegment(ch, subusersSegment, c.subuserMetrics)
+	}
+	if enableGeo {
+		c.collectSegment(ch, geoSegment, c.geoMetrics)
 	}
-	for _, s := range metrics[0].Stats {
-		ch <- prometheus.MustNewConstMetric(
-			c.dailyblocks,
-			prometheus.GaugeValue,
-			float64(s.Metrics.Blocks),
-			s.Type,
-			s.Name,
-		)
-		ch <- prometheus.MustNewConstMetric(
-			c.dailybounceDrops,
-			prometheus.GaugeValue,
-			float64(s.Metrics.BounceDrops),
-			s.Type,
-			s.Name,
-		)
-		ch <- prometheus.MustNewConstMetric(
-			c.dailybounces,
-			prometheus.GaugeValue,
-			float64(s.Metrics.Bounces),
-			s.Type,
-			s.Name,
-		)
-		ch <- prometheus.MustNewConstMetric(
-			c.dailyclicks,
-			prometheus.GaugeValue,
-			float64(s.Metrics.Clicks),
-			s.Type,
-			s.Name,
-		)
-		ch <- prometheus.MustNewConstMetric(
-			c.dailydeferred,
-			prometheus.GaugeValue,
-			float64(s.Metrics.Deferred),
-			s.Type,
-			s.Name,
-		)
-		ch <- prometheus.MustNewConstMetric(
-			c.dailydelivered,
-			prometheus.GaugeValue,
-			float64(s.Metrics.Delivered),
-			s.Type,
-			s.Name,
-		)
-		ch <- prometheus.MustNewConstMetric(
-			c.dailyinvalidEmails,
-			prometheus.GaugeValue,
-			float64(s.Metrics.InvalidEmails),
-			s.Type,
-			s.Name,
-		)
-		ch <- prometheus.MustNewConstMetric(
-			c.dailyopens,
-			prometheus.GaugeValue,
-			float64(s.Metrics.Opens),
-			s.Type,
-			s.Name,
-		)
-		ch <- prometheus.MustNewConstMetric(
-			c.dailyprocessed,
-			prometheus.GaugeValue,
-			float64(s.Metrics.Processed),
-			s.Type,
-			s.Name,
-		)
-		ch <- prometheus.MustNewConstMetric(
-			c.dailyrequests,
-			prometheus.GaugeValue,
-			float64(s.Metrics.Requests),
-			s.Type,
-			s.Name,
-		)
-		ch <- prometheus.MustNewConstMetric(
-			c.dailyspamReportDrops,
-			prometheus.GaugeValue,
-			float64(s.Metrics.SpamReportDrops),
-			s.Type,
-			s.Name,
-		)
-		ch <- prometheus.MustNewConstMetric(
-			c.dailyspamReports,
-			prometheus.GaugeValue,
-			float64(s.Metrics.SpamReports),
-			s.Type,
-			s.Name,
-		)
-		ch <- prometheus.MustNewConstMetric(
-			c.dailyuniqueClicks,
-			prometheus.GaugeValue,
-			float64(s.Metrics.UniqueClicks),
-			s.Type,
-			s.Name,
-		)
-		ch <- prometheus.MustNewConstMetric(
-			c.dailyuniqueOpens,
-			prometheus.GaugeValue,
-			float64(s.Metrics.UniqueOpens),
-			s.Type,
-			s.Name,
-		)
-		ch <- prometheus.MustNewConstMetric(
-			c.dailyunsubscribeDrops,
-			prometheus.GaugeValue,
-			float64(s.Metrics.UnsubscribeDrops),
-			s.Type,
-			s.Name,
-		)
-		ch <- prometheus.MustNewConstMetric(
-			c.dailyunsubscribes,
-			prometheus.GaugeValue,
-			float64(s.Metrics.Unsubscribes),
-			s.Type,
-			s.Name,
-		)
+	if enableBrowsers {
+		c.collectSegment(ch, browsersSegment, c.browserMetrics)
+	}
+	if enableMailboxProviders {
+		c.collectSegment(ch, mailboxProvidersSegment, c.mailboxProviderMetrics)
+	}
+}
+
+func (c *Collector) collectSegment(ch chan<- prometheus.Metric, seg segment, family metricFamily) {
+	extra := seg.query()
+	for _, aggregatedby := range []string{"day", "month"} {
+		result, err := c.scrapeStats(seg.path, aggregatedby, extra)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		for _, day := range result.stats {
+			for _, s := range day.Stats {
+				family.Collect(ch, s.Metrics, s.Name, aggregatedby, day.Date)
+			}
+		}
 	}
 }
 
@@ -639,22 +672,117 @@ type Statistics struct {
 	Stats []*Stat `json:"stats,omitempty"`
 }
 
-func collectMetrics(aggregadedby string) ([]*Statistics, error) {
+// scrapeError tags an error from fetchStats with a short, stable reason so
+// callers can bucket it into sendgrid_scrape_errors_total without parsing
+// error strings. rateLimit is non-nil whenever the failure happened after a
+// response came back (so its X-RateLimit-* headers are available), letting
+// scrapeStats keep the rate-limit gauges current even on a failed scrape -
+// exactly when an operator most needs to see a rate_limited 429 reflected
+// there.
+type scrapeError struct {
+	reason    string
+	err       error
+	rateLimit *rateLimitInfo
+}
+
+func (e *scrapeError) Error() string { return e.err.Error() }
+func (e *scrapeError) Unwrap() error { return e.err }
+
+// fetchResult bundles a stats response with the rate-limit state reported by
+// SendGrid alongside it, since both come off the same HTTP response.
+type fetchResult struct {
+	stats     []*Statistics
+	rateLimit rateLimitInfo
+}
+
+type rateLimitInfo struct {
+	remaining float64
+	reset     float64
+}
+
+// scrape wraps collectStats with the exporter's self-observability
+// metrics: scrape duration, tagged error counts, and the rate-limit gauges
+// reported by SendGrid for this aggregation window.
+func (c *Collector) scrape(aggregatedby string) (*fetchResult, error) {
+	return c.scrapeStats("stats", aggregatedby, nil)
+}
+
+// scrapeStats is the instrumented counterpart of collectStats: it records
+// scrape duration, tagged error counts, and the rate-limit gauges reported
+// by SendGrid for any of the stats endpoints, not just the account-wide one.
+func (c *Collector) scrapeStats(path, aggregatedby string, extra url.Values) (*fetchResult, error) {
+	start := time.Now()
+	result, err := collectStats(path, aggregatedby, extra)
+	c.scrapeDuration.WithLabelValues(path, aggregatedby).Observe(time.Since(start).Seconds())
 
-	u, err := url.Parse("https://api.sendgrid.com/v3/stats")
 	if err != nil {
+		reason := "http_error"
+		var se *scrapeError
+		if errors.As(err, &se) {
+			reason = se.reason
+			if se.rateLimit != nil {
+				c.rateLimitRemaining.WithLabelValues(path, aggregatedby).Set(se.rateLimit.remaining)
+				c.rateLimitReset.WithLabelValues(path, aggregatedby).Set(se.rateLimit.reset)
+			}
+		}
+		c.scrapeErrorsTotal.WithLabelValues(aggregatedby, reason).Inc()
 		return nil, err
 	}
 
-	today := time.Now().Format("2006-01-02")
+	c.rateLimitRemaining.WithLabelValues(path, aggregatedby).Set(result.rateLimit.remaining)
+	c.rateLimitReset.WithLabelValues(path, aggregatedby).Set(result.rateLimit.reset)
+
+	return result, nil
+}
+
+// collectStats fetches any of SendGrid's v3 stats endpoints (account-wide,
+// categories, subusers, geo, browsers, mailbox providers, ...). It checks
+// scrapeCache first, and falls back to sharing one in-flight request per
+// path/aggregated_by/filter/date-range combination across overlapping
+// callers via scrapeGroup on a miss.
+func collectStats(path, aggregadedby string, extra url.Values) (*fetchResult, error) {
+	start, end := dateRange()
+	key := path + "?" + extra.Encode() + "&aggregated_by=" + aggregadedby + "&start=" + start + "&end=" + end
+
+	if result, ok := scrapeCache.get(key); ok {
+		return result, nil
+	}
+
+	v, err, _ := scrapeGroup.Do(key, func() (interface{}, error) {
+		result, err := fetchStats(path, aggregadedby, extra)
+		if err != nil {
+			return nil, err
+		}
+		scrapeCache.set(key, result, cacheTTL(aggregadedby))
+		return result, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.(*fetchResult), nil
+}
+
+func fetchStats(path, aggregadedby string, extra url.Values) (*fetchResult, error) {
+
+	u, err := url.Parse("https://api.sendgrid.com/v3/" + path)
+	if err != nil {
+		return nil, err
+	}
+
+	start, end := dateRange()
 
 	query := url.Values{}
-	start := today     // YYYY-MM-DD
-	end := today       // YYYY-MM-DD
+	for k, vs := range extra {
+		for _, v := range vs {
+			query.Add(k, v)
+		}
+	}
 	by := aggregadedby //"day"    // day|week|month
 	query.Set("start_date", start)
 	query.Set("end_date", end)
-	query.Set("aggregated_by", by)
+	if by != "" {
+		query.Set("aggregated_by", by)
+	}
 	u.RawQuery = query.Encode()
 
 	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
@@ -663,28 +791,54 @@ func collectMetrics(aggregadedby string) ([]*Statistics, error) {
 	}
 	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", apiKey))
 
-	res, err := http.DefaultClient.Do(req)
+	res, err := httpClient.Do(req)
 	if err != nil {
-		return nil, err
+		return nil, &scrapeError{reason: "http_error", err: err}
 	}
 	defer res.Body.Close()
 
-	var r io.Reader = res.Body
-	r = io.TeeReader(r, os.Stdout)
+	rateLimit := parseRateLimit(res.Header)
 
 	switch res.StatusCode {
 	case http.StatusOK:
 		// do nothing
 	case http.StatusTooManyRequests:
-		return nil, fmt.Errorf("ireached API rate limit")
+		return nil, &scrapeError{reason: "rate_limited", err: fmt.Errorf("reached API rate limit"), rateLimit: &rateLimit}
 	default:
-		return nil, fmt.Errorf("invalid request")
+		return nil, &scrapeError{reason: "http_error", err: fmt.Errorf("invalid request: status %d", res.StatusCode), rateLimit: &rateLimit}
 	}
 
 	var data []*Statistics
-	if err := json.NewDecoder(r).Decode(&data); err != nil {
-		return nil, err
+	if err := json.NewDecoder(res.Body).Decode(&data); err != nil {
+		return nil, &scrapeError{reason: "decode_error", err: err, rateLimit: &rateLimit}
 	}
 
-	return data, nil
+	if len(data) == 0 {
+		return nil, &scrapeError{reason: "empty_response", err: fmt.Errorf("empty response"), rateLimit: &rateLimit}
+	}
+
+	return &fetchResult{stats: data, rateLimit: rateLimit}, nil
+}
+
+// parseRateLimit reads SendGrid's X-RateLimit-Remaining and X-RateLimit-Reset
+// response headers, converting the latter from the absolute Unix timestamp
+// SendGrid sends into the seconds-until-reset countdown the gauge is
+// documented as. Missing or unparsable headers, and a reset timestamp
+// already in the past, leave the zero value, which surfaces as 0 on the
+// corresponding gauge rather than failing the scrape.
+func parseRateLimit(h http.Header) rateLimitInfo {
+	var info rateLimitInfo
+	if v := h.Get("X-RateLimit-Remaining"); v != "" {
+		if f, err := strconv.ParseFloat(v, 64); err == nil {
+			info.remaining = f
+		}
+	}
+	if v := h.Get("X-RateLimit-Reset"); v != "" {
+		if epoch, err := strconv.ParseFloat(v, 64); err == nil {
+			if d := epoch - float64(time.Now().Unix()); d > 0 {
+				info.reset = d
+			}
+		}
+	}
+	return info
 }
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Which of the optional, dimension-segmented SendGrid stats endpoints are
+// enabled and which dimension values to filter each of them to. Categories
+// and subusers require at least one filter value since SendGrid won't
+// aggregate across an entire account's categories/subusers in one call;
+// geo, browsers, and mailbox providers can be scraped account-wide.
+var (
+	enableCategories       = envBool("SENDGRID_ENABLE_CATEGORIES")
+	enableSubusers         = envBool("SENDGRID_ENABLE_SUBUSERS")
+	enableGeo              = envBool("SENDGRID_ENABLE_GEO")
+	enableBrowsers         = envBool("SENDGRID_ENABLE_BROWSERS")
+	enableMailboxProviders = envBool("SENDGRID_ENABLE_MAILBOX_PROVIDERS")
+
+	categoriesSegment = segment{
+		path:     "categories/stats",
+		queryKey: "categories",
+		values:   envList("SENDGRID_CATEGORIES"),
+	}
+	subusersSegment = segment{
+		path:     "subusers/stats",
+		queryKey: "subusers",
+		values:   envList("SENDGRID_SUBUSERS"),
+	}
+	geoSegment = segment{
+		path:     "geo/stats",
+		queryKey: "country",
+		values:   envList("SENDGRID_COUNTRIES"),
+	}
+	browsersSegment = segment{
+		path:     "browsers/stats",
+		queryKey: "browsers",
+		values:   envList("SENDGRID_BROWSERS"),
+	}
+	mailboxProvidersSegment = segment{
+		path:     "mailbox_providers/stats",
+		queryKey: "mailbox_providers",
+		values:   envList("SENDGRID_MAILBOX_PROVIDERS"),
+	}
+)
+
+func envBool(name string) bool {
+	v, err := strconv.ParseBool(os.Getenv(name))
+	if err != nil {
+		return false
+	}
+	return v
+}
+
+func envList(name string) []string {
+	raw := os.Getenv(name)
+	if raw == "" {
+		return nil
+	}
+	var out []string
+	for _, v := range strings.Split(raw, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// segment describes one of the dimension-segmented SendGrid stats endpoints:
+// its API path, the query parameter SendGrid expects its filter values
+// under, and those filter values as configured via env or, in multi-account
+// mode, the account's config-file entry.
+type segment struct {
+	path     string
+	queryKey string
+	values   []string
+}
+
+// query builds the extra query parameters for this segment's filter values,
+// repeating queryKey once per configured value as the SendGrid API expects.
+func (s segment) query() url.Values {
+	q := url.Values{}
+	for _, v := range s.values {
+		q.Add(s.queryKey, v)
+	}
+	return q
+}
+
+// metricFamily is the set of per-Stat metric descriptors shared by every
+// stats endpoint (account-wide, categories, subusers, geo, browsers, mailbox
+// providers, ...), parameterized by a metric name prefix and the label used
+// for the segment's dimension. It exists so that adding a new segmented
+// endpoint doesn't mean hand-writing another 16 *prometheus.Desc fields.
+type metricFamily struct {
+	blocks           *prometheus.Desc
+	bounceDrops      *prometheus.Desc
+	bounces          *prometheus.Desc
+	clicks           *prometheus.Desc
+	deferred         *prometheus.Desc
+	delivered        *prometheus.Desc
+	invalidEmails    *prometheus.Desc
+	opens            *prometheus.Desc
+	processed        *prometheus.Desc
+	requests         *prometheus.Desc
+	spamReportDrops  *prometheus.Desc
+	spamReports      *prometheus.Desc
+	uniqueClicks     *prometheus.Desc
+	uniqueOpens      *prometheus.Desc
+	unsubscribeDrops *prometheus.Desc
+	unsubscribes     *prometheus.Desc
+}
+
+func newMetricFamily(subsystem string, labels []string) metricFamily {
+	desc := func(name string) *prometheus.Desc {
+		return prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, subsystem, name),
+			subsystem+" "+name,
+			labels,
+			nil,
+		)
+	}
+	return metricFamily{
+		blocks:           desc("blocks"),
+		bounceDrops:      desc("bounce_drops"),
+		bounces:          desc("bounces"),
+		clicks:           desc("clicks"),
+		deferred:         desc("deferred"),
+		delivered:        desc("delivered"),
+		invalidEmails:    desc("invalid_emails"),
+		opens:            desc("opens"),
+		processed:        desc("processed"),
+		requests:         desc("requests"),
+		spamReportDrops:  desc("spam_report_drops"),
+		spamReports:      desc("spam_reports"),
+		uniqueClicks:     desc("unique_clicks"),
+		uniqueOpens:      desc("unique_opens"),
+		unsubscribeDrops: desc("unsubscribe_drops"),
+		unsubscribes:     desc("unsubscribes"),
+	}
+}
+
+func (f metricFamily) Describe(ch chan<- *prometheus.Desc) {
+	ch <- f.blocks
+	ch <- f.bounceDrops
+	ch <- f.bounces
+	ch <- f.clicks
+	ch <- f.deferred
+	ch <- f.delivered
+	ch <- f.invalidEmails
+	ch <- f.opens
+	ch <- f.processed
+	ch <- f.requests
+	ch <- f.spamReportDrops
+	ch <- f.spamReports
+	ch <- f.uniqueClicks
+	ch <- f.uniqueOpens
+	ch <- f.unsubscribeDrops
+	ch <- f.unsubscribes
+}
+
+// Collect emits every metric in the family for one Stat. labelValues must be
+// given in the same order as the labels passed to newMetricFamily.
+func (f metricFamily) Collect(ch chan<- prometheus.Metric, m *Metrics, labelValues ...string) {
+	ch <- prometheus.MustNewConstMetric(f.blocks, prometheus.GaugeValue, float64(m.Blocks), labelValues...)
+	ch <- prometheus.MustNewConstMetric(f.bounceDrops, prometheus.GaugeValue, float64(m.BounceDrops), labelValues...)
+	ch <- prometheus.MustNewConstMetric(f.bounces, prometheus.GaugeValue, float64(m.Bounces), labelValues...)
+	ch <- prometheus.MustNewConstMetric(f.clicks, prometheus.GaugeValue, float64(m.Clicks), labelValues...)
+	ch <- prometheus.MustNewConstMetric(f.deferred, prometheus.GaugeValue, float64(m.Deferred), labelValues...)
+	ch <- prometheus.MustNewConstMetric(f.delivered, prometheus.GaugeValue, float64(m.Delivered), labelValues...)
+	ch <- prometheus.MustNewConstMetric(f.invalidEmails, prometheus.GaugeValue, float64(m.InvalidEmails), labelValues...)
+	ch <- prometheus.MustNewConstMetric(f.opens, prometheus.GaugeValue, float64(m.Opens), labelValues...)
+	ch <- prometheus.MustNewConstMetric(f.processed, prometheus.GaugeValue, float64(m.Processed), labelValues...)
+	ch <- prometheus.MustNewConstMetric(f.requests, prometheus.GaugeValue, float64(m.Requests), labelValues...)
+	ch <- prometheus.MustNewConstMetric(f.spamReportDrops, prometheus.GaugeValue, float64(m.SpamReportDrops), labelValues...)
+	ch <- prometheus.MustNewConstMetric(f.spamReports, prometheus.GaugeValue, float64(m.SpamReports), labelValues...)
+	ch <- prometheus.MustNewConstMetric(f.uniqueClicks, prometheus.GaugeValue, float64(m.UniqueClicks), labelValues...)
+	ch <- prometheus.MustNewConstMetric(f.uniqueOpens, prometheus.GaugeValue, float64(m.UniqueOpens), labelValues...)
+	ch <- prometheus.MustNewConstMetric(f.unsubscribeDrops, prometheus.GaugeValue, float64(m.UnsubscribeDrops), labelValues...)
+	ch <- prometheus.MustNewConstMetric(f.unsubscribes, prometheus.GaugeValue, float64(m.Unsubscribes), labelValues...)
+}